@@ -8,84 +8,594 @@
 package queue
 
 import (
+	"context"
 	"sync"
 )
 
-// Queue implements multiple-writer multiple-reader FIFO.
-// To push a message into queue send it to channel C.
-type Queue struct {
-	C              chan interface{}
-	salvager       func(interface{})
-	receivers      map[*Receiver]bool
+// Queue implements multiple-writer multiple-reader FIFO of messages of
+// type T. To push a message into queue send it to channel C.
+//
+// Call sites that never spelled the type out keep working unchanged:
+// New, NewWithBufferSize and friends infer T from the salvager function
+// passed to them, so New(func(interface{}) { ... }) still yields a
+// *Queue[interface{}]. This is NOT full backward compatibility, though:
+// Go has no way to alias a generic type under its own bare name (type
+// Queue = Queue[any] is a compile error, identifier collision), so code
+// that spells the type out, e.g. a struct field or variable of type
+// *queue.Queue or *queue.Receiver, does not compile anymore and must add
+// the type argument, becoming *queue.Queue[any] / *queue.Receiver[any].
+// That is a deliberate, unavoidable break, not an oversight.
+type Queue[T any] struct {
+	C              chan T
+	salvager       func(T)
+	receivers      map[*Receiver[T]]bool
 	receiversMutex sync.Mutex
+	pending        sync.WaitGroup
+	done           chan struct{}
+	closed         bool
+	// shutdownReceivers is populated by broadcaster just before it
+	// disconnects every remaining Receiver on shutdown; Close reads it
+	// after <-q.done, once broadcaster is done writing it.
+	shutdownReceivers []*Receiver[T]
+
+	// replayN, replayBuf, replayHead and replayCount implement the fixed-
+	// size replay ring used by ConnectWithReplay; they are guarded by
+	// receiversMutex like the rest of a Queue's receiver-facing state.
+	// replayN is 0 unless the Queue was created with NewWithReplay.
+	replayN     int
+	replayBuf   []T
+	replayHead  int
+	replayCount int
 }
 
 // Create new Queue. Function salvager is being called on a message
 // when all receivers have received it.
-func New(salvager func(interface{})) *Queue {
+// Receivers whose Filter rejects the message are not waited for, and a
+// message that a Receiver's DeliveryPolicy drops counts as taken by it.
+func New[T any](salvager func(T)) *Queue[T] {
 	return NewWithBufferSize(salvager, 16)
 }
 
 // Like New() but the size of input buffer can be set via bufsize.
-func NewWithBufferSize(salvager func(interface{}), bufsize int) *Queue {
-	q := &Queue{
-		C:         make(chan interface{}, bufsize),
-		receivers: make(map[*Receiver]bool),
+func NewWithBufferSize[T any](salvager func(T), bufsize int) *Queue[T] {
+	return newQueue(salvager, bufsize, 0)
+}
+
+// Like NewWithBufferSize() but the Queue also keeps a history of the
+// last replayN messages that passed through it, for ConnectWithReplay to
+// hand to late-joining Receivers.
+func NewWithReplay[T any](salvager func(T), bufsize, replayN int) *Queue[T] {
+	return newQueue(salvager, bufsize, replayN)
+}
+
+func newQueue[T any](salvager func(T), bufsize, replayN int) *Queue[T] {
+	q := &Queue[T]{
+		C:         make(chan T, bufsize),
+		receivers: make(map[*Receiver[T]]bool),
 		salvager:  salvager,
+		done:      make(chan struct{}),
+		replayN:   replayN,
+	}
+	if replayN > 0 {
+		q.replayBuf = make([]T, replayN)
 	}
 	go q.broadcaster()
 	return q
 }
 
-// Internal worker to replicate received messages to the receivers.
-func (q *Queue) broadcaster() {
+// Like New() but the Queue is closed automatically once ctx is done.
+func NewWithContext[T any](ctx context.Context, salvager func(T)) *Queue[T] {
+	return NewWithBufferSizeContext(ctx, salvager, 16)
+}
+
+// Like NewWithBufferSize() but the Queue is closed automatically once
+// ctx is done.
+func NewWithBufferSizeContext[T any](ctx context.Context, salvager func(T), bufsize int) *Queue[T] {
+	q := NewWithBufferSize(salvager, bufsize)
+	go func() {
+		select {
+		case <-ctx.Done():
+			q.Close()
+		case <-q.done:
+			// q was closed some other way (a direct Close call); stop
+			// watching ctx instead of leaking this goroutine for as
+			// long as ctx itself lives, which may be forever.
+		}
+	}()
+	return q
+}
+
+// Internal worker to fan a received message out to the receivers.
+// Handing a message to a Receiver never blocks the broadcaster itself
+// (see Receiver.enqueue): a single slow or stuck Receiver does not stall
+// delivery to the others. Salvage of a message still waits until every
+// matching Receiver has delivered or dropped it, or been disconnected.
+func (q *Queue[T]) broadcaster() {
+	defer close(q.done)
 	for v := range q.C {
 		q.receiversMutex.Lock()
+		q.appendReplay(v)
 		var wg sync.WaitGroup
 		for r := range q.receivers {
+			if r.filter != nil && !r.filter(v) {
+				continue
+			}
 			wg.Add(1)
-			go func(r *Receiver, v interface{}) {
-				r.C <- v
-				wg.Done()
-			}(r, v)
+			r.enqueue(v, &wg)
 		}
 		q.receiversMutex.Unlock()
-		go func(wg *sync.WaitGroup, v interface{}) {
+		q.pending.Add(1)
+		go func(wg *sync.WaitGroup, v T) {
+			defer q.pending.Done()
 			wg.Wait()
 			q.salvager(v)
 		}(&wg, v)
 	}
+	// q.C is only ever closed by Close, which means every message that
+	// was going to be dispatched has been: disconnect every remaining
+	// Receiver now, before waiting on q.pending, so a Receiver stuck on
+	// a blocking PolicyBlock send (nobody draining C) lets go of its
+	// in-flight message instead of stalling salvage, and Close, forever.
+	q.receiversMutex.Lock()
+	q.shutdownReceivers = make([]*Receiver[T], 0, len(q.receivers))
+	for r := range q.receivers {
+		q.shutdownReceivers = append(q.shutdownReceivers, r)
+		delete(q.receivers, r)
+	}
+	q.receiversMutex.Unlock()
+	for _, r := range q.shutdownReceivers {
+		r.disconnect()
+	}
+	q.pending.Wait()
+}
+
+// Close shuts the Queue down: it closes C, waits for the broadcaster to
+// drain and salvage every message already in flight (disconnecting any
+// remaining Receiver along the way), then waits for the channel of every
+// remaining Receiver to be closed. After Close returns, Connect and
+// ConnectWithBufferSize stop handing out new Receivers and return nil
+// instead. Close is idempotent.
+func (q *Queue[T]) Close() error {
+	q.receiversMutex.Lock()
+	if q.closed {
+		q.receiversMutex.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.receiversMutex.Unlock()
+
+	close(q.C)
+	<-q.done
+
+	// broadcaster populates shutdownReceivers and disconnects every one
+	// of them before closing q.done, so it's safe to read here without
+	// q.receiversMutex.
+	for _, r := range q.shutdownReceivers {
+		<-r.workerDone
+	}
+	return nil
+}
+
+// DeliveryPolicy controls what a Receiver's worker does when the
+// Receiver has not made room for the message it is about to deliver.
+type DeliveryPolicy int
+
+const (
+	// PolicyBlock waits for the Receiver to make room, same as a
+	// Receiver created without a policy.
+	PolicyBlock DeliveryPolicy = iota
+	// PolicyDropOldest evicts the oldest buffered message to make room
+	// for the new one, so the Receiver always sees the freshest data.
+	// With an unbuffered C there is nothing to evict: the new message is
+	// dropped unless a reader is waiting for it.
+	PolicyDropOldest
+	// PolicyDropNewest discards the new message if the Receiver's
+	// buffer is full, preserving whatever it already has queued.
+	PolicyDropNewest
+	// PolicyDisconnectSlow disconnects the Receiver once its buffer has
+	// been at or above LagThreshold for disconnectSlowAfter consecutive
+	// deliveries, then drops the message that triggered disconnection.
+	PolicyDisconnectSlow
+)
+
+// disconnectSlowAfter is the number of consecutive laggy deliveries
+// PolicyDisconnectSlow tolerates before disconnecting a Receiver.
+const disconnectSlowAfter = 3
+
+// ReceiverOptions configures a Receiver created via ConnectWithOptions.
+type ReceiverOptions[T any] struct {
+	// BufferSize is the size of the Receiver's channel buffer.
+	BufferSize int
+	// Policy picks what happens when the Receiver is not keeping up.
+	// The zero value is PolicyBlock.
+	Policy DeliveryPolicy
+	// LagThreshold is the buffer length, in messages, at or above which
+	// PolicyDisconnectSlow starts counting a Receiver as lagging.
+	LagThreshold int
+	// Filter, if non-nil, restricts the Receiver to messages for which
+	// it returns true. Messages it rejects never touch the Receiver's
+	// queue or buffer, and do not count against its DeliveryPolicy.
+	Filter func(T) bool
+}
+
+// ReceiverStats is a snapshot of a Receiver's delivery counters, as
+// returned by (*Receiver).Stats().
+type ReceiverStats struct {
+	// Delivered is the number of messages handed to the Receiver.
+	Delivered int
+	// Dropped is the number of messages the Receiver's policy chose
+	// not to deliver (including, for PolicyDisconnectSlow, the message
+	// that triggered disconnection). For PolicyDropOldest, a message
+	// evicted from C after it was delivered counts in both Delivered and
+	// Dropped.
+	Dropped int
+	// LastLag is the length of C, as observed on the last delivery
+	// attempt. Only meaningful for PolicyDisconnectSlow.
+	LastLag int
+}
+
+// message pairs a value pushed through the Queue with the WaitGroup the
+// broadcaster is using to find out when every Receiver has taken it. wg
+// is nil for messages ConnectWithReplay seeds a new Receiver with: the
+// salvager runs for them only through the WaitGroup of their original
+// delivery, so replaying them must not touch a WaitGroup again.
+type message[T any] struct {
+	v  T
+	wg *sync.WaitGroup
+}
+
+// appendReplay records v in the replay ring for future ConnectWithReplay
+// callers, evicting the oldest entry once the ring is full. appendReplay
+// is a no-op unless the Queue was created with NewWithReplay. Callers
+// must hold receiversMutex.
+func (q *Queue[T]) appendReplay(v T) {
+	if q.replayN == 0 {
+		return
+	}
+	idx := (q.replayHead + q.replayCount) % q.replayN
+	if q.replayCount < q.replayN {
+		q.replayBuf[idx] = v
+		q.replayCount++
+		return
+	}
+	q.replayBuf[q.replayHead] = v
+	q.replayHead = (q.replayHead + 1) % q.replayN
+}
+
+// replaySnapshot returns up to n of the most recently buffered replay
+// messages, oldest first. Callers must hold receiversMutex.
+func (q *Queue[T]) replaySnapshot(n int) []T {
+	if n > q.replayCount {
+		n = q.replayCount
+	}
+	if n <= 0 {
+		return nil
+	}
+	out := make([]T, n)
+	skip := q.replayCount - n
+	for i := 0; i < n; i++ {
+		idx := (q.replayHead + skip + i) % q.replayN
+		out[i] = q.replayBuf[idx]
+	}
+	return out
 }
 
 // Receiver is an entity to receive messages from the queue.
 // Messages will appear on channel C.
-type Receiver struct {
-	C chan interface{}
+//
+// Each Receiver has its own worker goroutine draining an internal,
+// unbounded queue of messages handed to it by the broadcaster; this is
+// what lets Connect's (or ConnectWithOptions') DeliveryPolicy act on a
+// Receiver without ever blocking the broadcaster or other Receivers.
+type Receiver[T any] struct {
+	C chan T
+
+	policy       DeliveryPolicy
+	lagThreshold int
+	filter       func(T) bool
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	queue        []message[T]
+	disconnected bool
+	workerDone   chan struct{}
+	// unblock is closed by disconnect, so a PolicyBlock send that is
+	// parked on r.C <- v (queue.go applyPolicy) wakes up and drops the
+	// message instead of leaving r's worker, and with it Close, stuck
+	// forever after a disconnect.
+	unblock chan struct{}
+
+	statsMutex  sync.Mutex
+	delivered   int
+	dropped     int
+	lastLag     int
+	laggedSends int
+}
+
+// Stats returns a snapshot of the Receiver's delivery counters. Stats
+// never blocks, even while r's worker is parked waiting to deliver a
+// message to a slow PolicyBlock Receiver.
+func (r *Receiver[T]) Stats() ReceiverStats {
+	r.statsMutex.Lock()
+	defer r.statsMutex.Unlock()
+	return ReceiverStats{
+		Delivered: r.delivered,
+		Dropped:   r.dropped,
+		LastLag:   r.lastLag,
+	}
+}
+
+// recordDelivered and recordDropped update r's delivery counters under
+// r.statsMutex. They are called around, never across, any wait on r.C,
+// so Stats can always take statsMutex without blocking on that wait.
+func (r *Receiver[T]) recordDelivered() {
+	r.statsMutex.Lock()
+	r.delivered++
+	r.statsMutex.Unlock()
+}
+
+func (r *Receiver[T]) recordDropped() {
+	r.statsMutex.Lock()
+	r.dropped++
+	r.statsMutex.Unlock()
+}
+
+// enqueue appends v to r's queue for its worker to pick up, or, if r has
+// already been disconnected, immediately marks v as handled. enqueue
+// never blocks.
+func (r *Receiver[T]) enqueue(v T, wg *sync.WaitGroup) {
+	r.mu.Lock()
+	if r.disconnected {
+		r.mu.Unlock()
+		wg.Done()
+		return
+	}
+	r.queue = append(r.queue, message[T]{v: v, wg: wg})
+	r.mu.Unlock()
+	r.cond.Signal()
+}
+
+// disconnect marks r as disconnected and wakes its worker, which will
+// drain any already-queued messages and close C once done. disconnect
+// is idempotent.
+func (r *Receiver[T]) disconnect() {
+	r.mu.Lock()
+	already := r.disconnected
+	r.disconnected = true
+	r.mu.Unlock()
+	if !already {
+		close(r.unblock)
+		r.cond.Signal()
+	}
+}
+
+// run is r's worker: it applies r's DeliveryPolicy to every message in
+// FIFO order, including ones still queued when r is disconnected, until
+// the queue has drained, then closes C. Only run ever sends on or closes
+// C, so a Disconnect racing with an in-flight delivery can't panic on a
+// closed channel. Draining queued messages through applyPolicy even
+// after disconnection, rather than dropping them outright, is what lets
+// Close (TestCloseDrainsAndClosesReceivers) still observe messages that
+// were already buffered when it ran.
+func (r *Receiver[T]) run(q *Queue[T]) {
+	defer close(r.workerDone)
+	for {
+		r.mu.Lock()
+		for len(r.queue) == 0 && !r.disconnected {
+			r.cond.Wait()
+		}
+		if len(r.queue) == 0 {
+			r.mu.Unlock()
+			close(r.C)
+			return
+		}
+		m := r.queue[0]
+		r.queue = r.queue[1:]
+		r.mu.Unlock()
+
+		q.applyPolicy(r, m.v)
+		if m.wg != nil {
+			m.wg.Done()
+		}
+	}
+}
+
+// applyPolicy hands v to r according to r's DeliveryPolicy, updating r's
+// Stats as it goes. It is only ever called from r's own worker
+// goroutine, so deliveries to a given Receiver are always applied in
+// the order the broadcaster received them. It never holds statsMutex
+// across a wait on r.C, so a caller polling Stats on a slow or stuck
+// Receiver is never blocked by it.
+func (q *Queue[T]) applyPolicy(r *Receiver[T], v T) {
+	switch r.policy {
+	case PolicyDropNewest:
+		select {
+		case r.C <- v:
+			r.recordDelivered()
+		default:
+			r.recordDropped()
+		}
+	case PolicyDropOldest:
+		if cap(r.C) == 0 {
+			select {
+			case r.C <- v:
+				r.recordDelivered()
+			default:
+				r.recordDropped()
+			}
+			return
+		}
+		for {
+			select {
+			case r.C <- v:
+				r.recordDelivered()
+				return
+			default:
+			}
+			select {
+			case <-r.C:
+				r.recordDropped()
+			default:
+			}
+		}
+	case PolicyDisconnectSlow:
+		lag := len(r.C)
+		r.statsMutex.Lock()
+		r.lastLag = lag
+		if lag >= r.lagThreshold {
+			r.laggedSends++
+		} else {
+			r.laggedSends = 0
+		}
+		lagging := r.laggedSends >= disconnectSlowAfter
+		r.statsMutex.Unlock()
+		if lagging {
+			r.recordDropped()
+			q.Disconnect(r)
+			return
+		}
+		select {
+		case r.C <- v:
+			r.recordDelivered()
+		default:
+			r.recordDropped()
+		}
+	default: // PolicyBlock
+		// Try a non-blocking send first: if there's room, deliver
+		// unconditionally, even if r has since been disconnected. Only
+		// fall back to a real wait - cancellable via r.unblock, and
+		// without holding statsMutex - when the Receiver isn't keeping
+		// up, so a disconnected-but-stuck Receiver can't block its own
+		// worker (and Close), or a Stats() caller, forever.
+		select {
+		case r.C <- v:
+			r.recordDelivered()
+		default:
+			select {
+			case r.C <- v:
+				r.recordDelivered()
+			case <-r.unblock:
+				r.recordDropped()
+			}
+		}
+	}
 }
 
 // Connect creates new Receiver attached to the queue.
 // Only subsequent messages will appear on that Receiver.
-func (q *Queue) Connect() *Receiver {
-	return q.ConnectWithBufferSize(0)
+// Connect returns nil if the Queue has been closed.
+func (q *Queue[T]) Connect() *Receiver[T] {
+	return q.ConnectWithOptions(ReceiverOptions[T]{})
 }
 
 // Like Connect but Receiver buffer size can be set via bufsize.
-func (q *Queue) ConnectWithBufferSize(bufsize int) *Receiver {
+func (q *Queue[T]) ConnectWithBufferSize(bufsize int) *Receiver[T] {
+	return q.ConnectWithOptions(ReceiverOptions[T]{BufferSize: bufsize})
+}
+
+// ConnectWithFilter is like Connect but the Receiver only sees messages
+// for which filter returns true. Messages filter rejects are never
+// queued for this Receiver and do not count towards its DeliveryPolicy;
+// the salvager still runs on them as soon as every matching Receiver
+// has taken them.
+func (q *Queue[T]) ConnectWithFilter(filter func(T) bool) *Receiver[T] {
+	return q.ConnectWithOptions(ReceiverOptions[T]{Filter: filter})
+}
+
+// ConnectWithOptions is like Connect but lets the caller pick the
+// Receiver's buffer size, DeliveryPolicy and Filter. ConnectWithOptions
+// returns nil if the Queue has been closed.
+func (q *Queue[T]) ConnectWithOptions(opts ReceiverOptions[T]) *Receiver[T] {
 	q.receiversMutex.Lock()
 	defer q.receiversMutex.Unlock()
-	r := &Receiver{
-		C: make(chan interface{}, bufsize),
+	if q.closed {
+		return nil
+	}
+	r := &Receiver[T]{
+		C:            make(chan T, opts.BufferSize),
+		policy:       opts.Policy,
+		lagThreshold: opts.LagThreshold,
+		filter:       opts.Filter,
+		workerDone:   make(chan struct{}),
+		unblock:      make(chan struct{}),
 	}
+	r.cond = sync.NewCond(&r.mu)
 	q.receivers[r] = true
+	go r.run(q)
 	return r
 }
 
-// Disconnect detached specified Receiver from the queue so it
-// will no longer receive messages. Note that C is closed after
-// calling Disconnect.
-func (q *Queue) Disconnect(r *Receiver) {
+// ConnectWithReplay is like Connect but immediately seeds the new
+// Receiver with up to n of the most recent messages that passed through
+// the queue before it connected, capped at the replayN the Queue was
+// created with via NewWithReplay (0 if it was not). Replayed messages do
+// not re-trigger the salvager: it runs for them only once their original
+// delivery's WaitGroup completes. ConnectWithReplay returns nil
+// if the Queue has been closed.
+func (q *Queue[T]) ConnectWithReplay(n int) *Receiver[T] {
 	q.receiversMutex.Lock()
 	defer q.receiversMutex.Unlock()
+	if q.closed {
+		return nil
+	}
+	if n > q.replayN {
+		n = q.replayN
+	}
+	replay := q.replaySnapshot(n)
+	r := &Receiver[T]{
+		C:          make(chan T),
+		workerDone: make(chan struct{}),
+		unblock:    make(chan struct{}),
+	}
+	r.cond = sync.NewCond(&r.mu)
+	r.queue = make([]message[T], len(replay))
+	for i, v := range replay {
+		r.queue[i] = message[T]{v: v}
+	}
+	q.receivers[r] = true
+	go r.run(q)
+	return r
+}
+
+// Disconnect detaches specified Receiver from the queue so it will no
+// longer receive messages. C is closed once r's worker has drained any
+// messages it was already handed, which may be after Disconnect
+// returns. Disconnecting a Receiver that is not connected (or already
+// disconnected, e.g. by Close) is a no-op.
+func (q *Queue[T]) Disconnect(r *Receiver[T]) {
+	q.receiversMutex.Lock()
+	if _, ok := q.receivers[r]; !ok {
+		q.receiversMutex.Unlock()
+		return
+	}
 	delete(q.receivers, r)
-	close(r.C)
+	q.receiversMutex.Unlock()
+
+	r.disconnect()
+}
+
+// Topic wraps a payload with the name it was published under. It is the
+// message type expected by PublishTo and ConnectTopic, e.g. a
+// queue.New[queue.Topic[Event]](salvager) can be published to by topic
+// name and subscribed to by topic name.
+//
+// Topic-based pub/sub is a ConnectWithFilter matching on Name, packaged
+// as free functions rather than Queue/Receiver methods: a method can
+// only be declared for Queue[T] in general, not for the specific
+// instantiation Queue[Topic[T]] that PublishTo and ConnectTopic need.
+type Topic[T any] struct {
+	Name    string
+	Payload T
+}
+
+// PublishTo sends v to q tagged with topic, for ConnectTopic(topic) (or
+// a Name-matching ConnectWithFilter) to pick up.
+func PublishTo[T any](q *Queue[Topic[T]], topic string, v T) {
+	q.C <- Topic[T]{Name: topic, Payload: v}
+}
+
+// ConnectTopic creates a Receiver that only sees messages PublishTo
+// published to q under the given topic name.
+func ConnectTopic[T any](q *Queue[Topic[T]], topic string) *Receiver[Topic[T]] {
+	return q.ConnectWithFilter(func(m Topic[T]) bool { return m.Name == topic })
 }
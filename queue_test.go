@@ -0,0 +1,407 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCloseDrainsAndClosesReceivers(t *testing.T) {
+	var salvaged []interface{}
+	var salvagedMutex sync.Mutex
+	q := New(func(v interface{}) {
+		salvagedMutex.Lock()
+		salvaged = append(salvaged, v)
+		salvagedMutex.Unlock()
+	})
+	r := q.ConnectWithBufferSize(2)
+
+	q.C <- 1
+	q.C <- 2
+
+	if err := q.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	var got []interface{}
+	for v := range r.C {
+		got = append(got, v)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected receiver to observe 2 messages before being closed, got %d", len(got))
+	}
+
+	salvagedMutex.Lock()
+	defer salvagedMutex.Unlock()
+	if len(salvaged) != 2 {
+		t.Fatalf("expected salvager to run for both in-flight messages, got %d", len(salvaged))
+	}
+}
+
+func TestConnectAfterCloseReturnsNil(t *testing.T) {
+	q := New(func(interface{}) {})
+	if err := q.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if r := q.Connect(); r != nil {
+		t.Fatalf("expected Connect on a closed Queue to return nil, got %v", r)
+	}
+}
+
+func TestCloseIsIdempotent(t *testing.T) {
+	q := New(func(interface{}) {})
+	if err := q.Close(); err != nil {
+		t.Fatalf("first Close returned error: %v", err)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatalf("second Close returned error: %v", err)
+	}
+}
+
+func TestCloseConcurrentWithConnectAndDisconnect(t *testing.T) {
+	q := New(func(interface{}) {})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := q.Connect()
+			if r == nil {
+				return
+			}
+			q.Disconnect(r)
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		q.Close()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("concurrent Connect/Disconnect/Close did not finish in time")
+	}
+}
+
+func TestCloseDoesNotHangOnStuckBlockingReceiver(t *testing.T) {
+	q := New(func(interface{}) {})
+	r := q.Connect() // unbuffered, PolicyBlock, nobody ever reads r.C
+
+	q.C <- 1
+	q.C <- 2
+
+	done := make(chan struct{})
+	go func() {
+		q.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return with a stuck PolicyBlock receiver")
+	}
+	_ = r
+}
+
+func TestDisconnectDoesNotLeakStuckBlockingReceiver(t *testing.T) {
+	q := New(func(interface{}) {})
+	defer q.Close()
+	r := q.Connect() // unbuffered, PolicyBlock, nobody ever reads r.C
+
+	q.C <- 1
+	q.Disconnect(r)
+
+	select {
+	case <-r.workerDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Disconnect left r's worker goroutine stuck on a blocking send")
+	}
+}
+
+func TestStatsDoesNotBlockOnStuckBlockingReceiver(t *testing.T) {
+	q := New(func(interface{}) {})
+	defer q.Close()
+	r := q.Connect() // unbuffered, PolicyBlock, nobody ever reads r.C
+
+	q.C <- 1 // r's worker is now parked sending this to r.C
+
+	done := make(chan struct{})
+	go func() {
+		r.Stats()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stats blocked on a Receiver stuck delivering a message")
+	}
+}
+
+func TestTypedQueue(t *testing.T) {
+	var salvaged []int
+	var salvagedMutex sync.Mutex
+	q := New(func(v int) {
+		salvagedMutex.Lock()
+		salvaged = append(salvaged, v)
+		salvagedMutex.Unlock()
+	})
+	defer q.Close()
+
+	r := q.ConnectWithBufferSize(1)
+	q.C <- 42
+	if v := <-r.C; v != 42 {
+		t.Fatalf("expected to receive 42, got %d", v)
+	}
+}
+
+func TestPolicyDropNewest(t *testing.T) {
+	q := New(func(int) {})
+	defer q.Close()
+
+	r := q.ConnectWithOptions(ReceiverOptions[int]{BufferSize: 1, Policy: PolicyDropNewest})
+	q.C <- 1
+	q.C <- 2 // receiver buffer is full and unread, this one should be dropped
+
+	waitForStats(t, r, func(s ReceiverStats) bool { return s.Delivered == 1 && s.Dropped == 1 })
+
+	if v := <-r.C; v != 1 {
+		t.Fatalf("expected first message to survive, got %d", v)
+	}
+}
+
+func TestPolicyDropOldest(t *testing.T) {
+	q := New(func(int) {})
+	defer q.Close()
+
+	r := q.ConnectWithOptions(ReceiverOptions[int]{BufferSize: 1, Policy: PolicyDropOldest})
+	q.C <- 1
+	q.C <- 2 // should evict the still-unread 1 and keep 2
+
+	waitForStats(t, r, func(s ReceiverStats) bool { return s.Delivered == 2 && s.Dropped == 1 })
+
+	if v := <-r.C; v != 2 {
+		t.Fatalf("expected newest message to survive, got %d", v)
+	}
+}
+
+func TestPolicyDisconnectSlow(t *testing.T) {
+	q := New(func(int) {})
+	defer q.Close()
+
+	r := q.ConnectWithOptions(ReceiverOptions[int]{
+		BufferSize:   1,
+		Policy:       PolicyDisconnectSlow,
+		LagThreshold: 1,
+	})
+
+	// Send without draining r.C so every message beyond the first sees
+	// the buffer still full, guaranteeing disconnectSlowAfter
+	// consecutive laggy deliveries.
+	for i := 0; i < disconnectSlowAfter+5; i++ {
+		q.C <- i
+	}
+
+	// Wait for the disconnect to actually happen (via Stats, not C:
+	// reading C here would drain the one buffered message and let more
+	// of the backlog through before the lag threshold is hit).
+	waitForStats(t, r, func(s ReceiverStats) bool { return s.Dropped >= disconnectSlowAfter })
+
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-r.C:
+			if !ok {
+				return // receiver was disconnected and its channel closed
+			}
+		case <-deadline:
+			t.Fatal("receiver was never disconnected for lagging")
+		}
+	}
+}
+
+func waitForStats(t *testing.T, r *Receiver[int], done func(ReceiverStats) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if done(r.Stats()) {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("stats did not reach expected state in time, last seen: %+v", r.Stats())
+}
+
+func TestConnectWithFilter(t *testing.T) {
+	var salvaged []int
+	var salvagedMutex sync.Mutex
+	q := New(func(v int) {
+		salvagedMutex.Lock()
+		salvaged = append(salvaged, v)
+		salvagedMutex.Unlock()
+	})
+	defer q.Close()
+
+	evens := q.ConnectWithFilter(func(v int) bool { return v%2 == 0 })
+
+	for i := 1; i <= 4; i++ {
+		q.C <- i
+	}
+
+	var got []int
+	for i := 0; i < 2; i++ {
+		got = append(got, <-evens.C)
+	}
+	if got[0] != 2 || got[1] != 4 {
+		t.Fatalf("expected only even messages in order, got %v", got)
+	}
+
+	// The salvager must still run on the odd messages even though evens
+	// never sees them: a filtered-out message isn't waited on by the
+	// broadcaster's per-message WaitGroup for this Receiver.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		salvagedMutex.Lock()
+		n := len(salvaged)
+		salvagedMutex.Unlock()
+		if n == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("salvager did not run on all 4 messages in time, got %d", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPublishToAndConnectTopic(t *testing.T) {
+	q := New(func(Topic[int]) {})
+	defer q.Close()
+
+	odds := ConnectTopic(q, "odd")
+	evens := ConnectTopic(q, "even")
+
+	for i := 1; i <= 4; i++ {
+		topic := "even"
+		if i%2 != 0 {
+			topic = "odd"
+		}
+		PublishTo(q, topic, i)
+	}
+
+	if v := <-odds.C; v.Payload != 1 {
+		t.Fatalf("expected first odd payload 1, got %d", v.Payload)
+	}
+	if v := <-odds.C; v.Payload != 3 {
+		t.Fatalf("expected second odd payload 3, got %d", v.Payload)
+	}
+	if v := <-evens.C; v.Payload != 2 {
+		t.Fatalf("expected first even payload 2, got %d", v.Payload)
+	}
+	if v := <-evens.C; v.Payload != 4 {
+		t.Fatalf("expected second even payload 4, got %d", v.Payload)
+	}
+}
+
+func TestNewWithContextClosesOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := NewWithContext(ctx, func(interface{}) {})
+	r := q.Connect()
+	if r == nil {
+		t.Fatal("expected Connect to succeed before cancellation")
+	}
+
+	cancel()
+
+	select {
+	case _, ok := <-r.C:
+		if ok {
+			t.Fatal("expected receiver channel to be closed without pending messages")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("receiver was not closed after context cancellation")
+	}
+
+	if q.Connect() != nil {
+		t.Fatal("expected Connect after context cancellation to return nil")
+	}
+}
+
+func TestConnectWithReplay(t *testing.T) {
+	var salvaged []int
+	var salvagedMutex sync.Mutex
+	q := NewWithReplay(func(v int) {
+		salvagedMutex.Lock()
+		salvaged = append(salvaged, v)
+		salvagedMutex.Unlock()
+	}, 16, 2)
+	defer q.Close()
+
+	early := q.ConnectWithBufferSize(1)
+	for i := 1; i <= 4; i++ {
+		q.C <- i
+		if v := <-early.C; v != i {
+			t.Fatalf("expected early receiver to see %d, got %d", i, v)
+		}
+	}
+
+	late := q.ConnectWithReplay(5) // more than replayN, should cap at 2
+	if v := <-late.C; v != 3 {
+		t.Fatalf("expected first replayed message to be 3, got %d", v)
+	}
+	if v := <-late.C; v != 4 {
+		t.Fatalf("expected second replayed message to be 4, got %d", v)
+	}
+
+	q.C <- 5
+	if v := <-late.C; v != 5 {
+		t.Fatalf("expected live message 5 after replay, got %d", v)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		salvagedMutex.Lock()
+		n := len(salvaged)
+		salvagedMutex.Unlock()
+		if n == 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("salvager did not run exactly once per message in time, got %d calls", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConnectWithReplayCapsBelowQueueReplayN(t *testing.T) {
+	q := NewWithReplay(func(int) {}, 16, 5)
+	defer q.Close()
+
+	// drain connects first, since a Receiver only sees messages sent after
+	// it connects; once it has all 3, the broadcaster has recorded them in
+	// the replay ring that a Receiver with no messages of its own observes.
+	drain := q.ConnectWithBufferSize(3)
+	for i := 1; i <= 3; i++ {
+		q.C <- i
+	}
+	for i := 1; i <= 3; i++ {
+		<-drain.C
+	}
+
+	r := q.ConnectWithReplay(2)
+	if v := <-r.C; v != 2 {
+		t.Fatalf("expected first of the last 2 replayed messages to be 2, got %d", v)
+	}
+	if v := <-r.C; v != 3 {
+		t.Fatalf("expected second of the last 2 replayed messages to be 3, got %d", v)
+	}
+}